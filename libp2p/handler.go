@@ -1,8 +1,12 @@
 package libp2p
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"errors"
+	stdnet "net"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,9 +15,14 @@ import (
 	"github.com/ethereum/go-ethereum/rlp"
 	crypto "github.com/libp2p/go-libp2p-crypto"
 	net "github.com/libp2p/go-libp2p-net"
+	"github.com/status-im/whisper/ratelimiter"
 	"github.com/status-im/whisper/whisperv6"
 )
 
+// errIngressExhausted is returned once a stream's ingress bucket has
+// stayed empty for longer than the configured grace period.
+var errIngressExhausted = errors.New("libp2p: ingress rate limit exceeded for longer than the grace period")
+
 type connection struct {
 	id discover.NodeID
 
@@ -50,16 +59,158 @@ func PubKeyToNodeID(pubkey crypto.PubKey) (n discover.NodeID, err error) {
 	return discover.PubkeyID((*ecdsa.PublicKey)(seckey)), nil
 }
 
-func Handle(w *whisperv6.Whisper, s net.Stream, period, read, write time.Duration) error {
+// ratelimiterAddr is a net.Addr wrapping the IP parsed out of a libp2p
+// stream's remote multiaddr, so ratelimiter.Peer's RemoteAddr-based
+// byIP mode works the same way it does for devp2p peers.
+type ratelimiterAddr struct {
+	network string
+	ip      stdnet.IP
+}
+
+func (a ratelimiterAddr) Network() string { return a.network }
+
+// String returns "unknown" rather than panicking when ip is nil, so a
+// stream whose remote multiaddr has no ip4/ip6 component (remoteIP
+// failed) still produces a usable, non-nil net.Addr: "unknown" parses to
+// no IP, so every peer in that situation collides into the same
+// empty-key bucket in IPMode/SubnetMode rather than crashing the
+// connection.
+func (a ratelimiterAddr) String() string {
+	if a.ip == nil {
+		return "unknown"
+	}
+	return a.ip.String()
+}
+
+// ratelimiterPeer adapts a libp2p stream's identity to
+// ratelimiter.Peer, so PeerRateLimiter can key buckets by node ID or by
+// IP exactly as it does for devp2p peers.
+type ratelimiterPeer struct {
+	id   discover.NodeID
+	addr stdnet.Addr
+}
+
+func (p ratelimiterPeer) ID() discover.NodeID     { return p.id }
+func (p ratelimiterPeer) RemoteAddr() stdnet.Addr { return p.addr }
+
+// remoteIP extracts the ip4/ip6 component out of s's remote multiaddr,
+// e.g. "/ip4/1.2.3.4/tcp/30303" -> 1.2.3.4.
+func remoteIP(s net.Stream) (stdnet.IP, error) {
+	parts := strings.Split(s.Conn().RemoteMultiaddr().String(), "/")
+	for i, part := range parts {
+		if part != "ip4" && part != "ip6" {
+			continue
+		}
+		if i+1 >= len(parts) {
+			break
+		}
+		if ip := stdnet.ParseIP(parts[i+1]); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, errors.New("libp2p: remote multiaddr has no ip4/ip6 component")
+}
+
+// rateLimitedStream wraps a libp2p net.Stream so every Read/Write goes
+// through a PeerRateLimiter, extending the same protections
+// ratelimiter.ForWhisper provides devp2p peers to libp2p ones. Once the
+// ingress bucket has stayed exhausted for longer than grace, the stream
+// is closed; a zero grace never closes it.
+type rateLimitedStream struct {
+	net.Stream
+
+	ingress, egress ratelimiter.PeerRateLimiter
+	peer            ratelimiter.Peer
+	grace           time.Duration
+
+	mu        sync.Mutex
+	exhausted time.Time
+}
+
+func (s *rateLimitedStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	if s.ingress.Available(s.peer) <= 0 {
+		if s.exhausted.IsZero() {
+			s.exhausted = time.Now()
+		}
+		if s.grace > 0 && time.Since(s.exhausted) > s.grace {
+			s.mu.Unlock()
+			_ = s.Stream.Close()
+			return 0, errIngressExhausted
+		}
+	} else {
+		s.exhausted = time.Time{}
+	}
+	s.mu.Unlock()
+
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		s.ingress.TakeAvailable(s.peer, int64(n))
+	}
+	return n, err
+}
+
+func (s *rateLimitedStream) Write(p []byte) (int, error) {
+	s.egress.TakeAvailable(s.peer, int64(len(p)))
+	return s.Stream.Write(p)
+}
+
+// Handle wires up a newly accepted libp2p stream to w, guarding it with
+// rl the same way HandleConnection's devp2p callers are guarded: reads
+// and writes are metered against rl.Ingress/rl.Egress, keyed by the
+// peer's NodeID (derived from its public key) or, in IPMode, by the IP
+// parsed out of the stream's remote multiaddr. An ingress bucket left
+// exhausted for longer than a non-zero grace closes the stream. The stream, and
+// the underlying HandleConnection call, are also torn down as soon as
+// ctx is done, so a host node can shut every open stream down
+// deterministically instead of relying on per-stream timeouts.
+func Handle(ctx context.Context, w *whisperv6.Whisper, rl ratelimiter.Whisper, s net.Stream, period, read, write, grace time.Duration) error {
 	id, err := PubKeyToNodeID(s.Conn().RemotePublicKey())
 	if err != nil {
 		return err
 	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+		case <-stop:
+		}
+	}()
+
+	ip, ipErr := remoteIP(s)
+	if ipErr != nil {
+		log.Warn("libp2p: could not determine remote ip for rate limiting", "err", ipErr)
+	}
+	// Always a concrete ratelimiterAddr, even with a nil ip, so
+	// RemoteAddr() is never a nil net.Addr interface: ratelimiter.peerIP
+	// calls peer.RemoteAddr().String() unconditionally in IPMode/SubnetMode,
+	// which would panic on a nil interface value.
+	peer := ratelimiterPeer{id: id, addr: ratelimiterAddr{network: "libp2p", ip: ip}}
+
+	if err := rl.Ingress.Create(peer, rl.Config); err != nil {
+		return err
+	}
+	if err := rl.Egress.Create(peer, rl.Config); err != nil {
+		return err
+	}
+
 	conn := connection{id: id, period: period, received: new(atomic.Value)}
 	conn.Update(time.Time{})
+
+	limited := &rateLimitedStream{
+		Stream:  s,
+		ingress: rl.Ingress,
+		egress:  rl.Egress,
+		peer:    peer,
+		grace:   grace,
+	}
+
 	return w.HandleConnection(conn, Stream{
-		s:            s,
-		rlp:          rlp.NewStream(s, 0),
+		s:            limited,
+		rlp:          rlp.NewStream(limited, 0),
 		readTimeout:  read,
 		writeTimeout: write,
 	})
@@ -0,0 +1,73 @@
+package ratelimiter
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// AtomicConfig holds a Config that can be swapped out from a background
+// goroutine — such as CostTracker renegotiating a peer's allowance —
+// while its readers never block on a lock.
+type AtomicConfig struct {
+	v atomic.Value
+}
+
+// NewAtomicConfig returns an AtomicConfig initialized to cfg.
+func NewAtomicConfig(cfg Config) *AtomicConfig {
+	a := &AtomicConfig{}
+	a.Store(cfg)
+	return a
+}
+
+// Load returns the currently active Config.
+func (a *AtomicConfig) Load() Config {
+	return a.v.Load().(Config)
+}
+
+// Store atomically replaces the active Config.
+func (a *AtomicConfig) Store(cfg Config) {
+	a.v.Store(cfg)
+}
+
+// PeerConfigs is a registry of one AtomicConfig per peer id, shared by a
+// CostTracker.Run loop and whatever applies its decisions.
+type PeerConfigs struct {
+	mu   sync.Mutex
+	byID map[string]*AtomicConfig
+}
+
+// NewPeerConfigs returns an empty PeerConfigs registry.
+func NewPeerConfigs() *PeerConfigs {
+	return &PeerConfigs{byID: make(map[string]*AtomicConfig)}
+}
+
+// Get returns the AtomicConfig tracked for id, creating it (initialized
+// to fallback) on first use.
+func (p *PeerConfigs) Get(id []byte, fallback Config) *AtomicConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cfg, ok := p.byID[string(id)]
+	if !ok {
+		cfg = NewAtomicConfig(fallback)
+		p.byID[string(id)] = cfg
+	}
+	return cfg
+}
+
+// Remove stops tracking id, e.g. once its peer has disconnected.
+func (p *PeerConfigs) Remove(id []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.byID, string(id))
+}
+
+// ids returns the ids currently tracked.
+func (p *PeerConfigs) ids() [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := make([][]byte, 0, len(p.byID))
+	for k := range p.byID {
+		ids = append(ids, []byte(k))
+	}
+	return ids
+}
@@ -0,0 +1,131 @@
+package ratelimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CostTrackerConfig bounds how CostTracker derives a peer's renegotiated
+// Config.
+type CostTrackerConfig struct {
+	// TargetCostPerByte is the moving-average cost-units-per-byte a peer
+	// is allowed to consume before its allowance starts shrinking. Units
+	// are caller-defined (e.g. nanoseconds spent on PoW validation plus
+	// bloom-filter matching).
+	TargetCostPerByte float64
+	// MinCapacity/MaxCapacity bound how far a single renegotiation can
+	// move a peer's Capacity. Zero disables the corresponding bound.
+	MinCapacity, MaxCapacity int64
+	// Alpha is the EWMA smoothing factor applied to each cost sample, in
+	// (0, 1]; higher reacts faster to recent packets.
+	Alpha float64
+}
+
+type costAverage struct {
+	unitsPerByte float64
+	init         bool
+}
+
+// CostTracker measures the true per-peer packet cost and uses it to
+// periodically re-derive that peer's Config, mirroring the cost tracker
+// LES uses to self-tune capacity.
+type CostTracker struct {
+	mu   sync.Mutex
+	cfg  CostTrackerConfig
+	cost map[string]*costAverage
+}
+
+// NewCostTracker returns a CostTracker configured with cfg.
+func NewCostTracker(cfg CostTrackerConfig) *CostTracker {
+	return &CostTracker{cfg: cfg, cost: make(map[string]*costAverage)}
+}
+
+// Record folds in the cost of processing a single packet from id: units
+// is the work done to validate/decrypt it, size is its byte size on the
+// wire.
+func (c *CostTracker) Record(id []byte, units float64, size int64) {
+	if size <= 0 {
+		return
+	}
+	perByte := units / float64(size)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	avg, ok := c.cost[string(id)]
+	if !ok {
+		avg = &costAverage{}
+		c.cost[string(id)] = avg
+	}
+	if !avg.init {
+		avg.unitsPerByte = perByte
+		avg.init = true
+		return
+	}
+	avg.unitsPerByte += c.cfg.Alpha * (perByte - avg.unitsPerByte)
+}
+
+// Renegotiate derives the Config id should use next, given its current
+// Config and how much of its existing allowance it has been utilizing
+// (0..1): an expensive peer gets throttled, a cheap well-utilized one
+// gets raised, everyone else is left unchanged.
+func (c *CostTracker) Renegotiate(id []byte, current Config, utilization float64) Config {
+	c.mu.Lock()
+	avg, ok := c.cost[string(id)]
+	c.mu.Unlock()
+	if !ok || !avg.init || c.cfg.TargetCostPerByte <= 0 {
+		return current
+	}
+
+	ratio := avg.unitsPerByte / c.cfg.TargetCostPerByte
+	next := current
+	switch {
+	case ratio > 1:
+		next.Capacity = c.scaleCapacity(current.Capacity, 1/ratio)
+	case ratio < 1 && utilization > 0.8:
+		next.Capacity = c.scaleCapacity(current.Capacity, 1+(1-ratio))
+	default:
+		return current
+	}
+	if next.Quantum > next.Capacity {
+		next.Quantum = next.Capacity
+	}
+	return next
+}
+
+// Run drives periodic renegotiation: every interval it re-derives each
+// id tracked in configs via Renegotiate and, if it changed, stores the
+// result back into configs and hands it to apply. Run blocks until ctx
+// is done.
+func (c *CostTracker) Run(ctx context.Context, interval time.Duration, configs *PeerConfigs, utilization func(id []byte) float64, apply func(id []byte, cfg Config)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, id := range configs.ids() {
+				atomicCfg := configs.Get(id, Config{})
+				current := atomicCfg.Load()
+				next := c.Renegotiate(id, current, utilization(id))
+				if next == current {
+					continue
+				}
+				atomicCfg.Store(next)
+				apply(id, next)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *CostTracker) scaleCapacity(capacity int64, factor float64) int64 {
+	scaled := int64(float64(capacity) * factor)
+	if c.cfg.MinCapacity > 0 && scaled < c.cfg.MinCapacity {
+		scaled = c.cfg.MinCapacity
+	}
+	if c.cfg.MaxCapacity > 0 && scaled > c.cfg.MaxCapacity {
+		scaled = c.cfg.MaxCapacity
+	}
+	return scaled
+}
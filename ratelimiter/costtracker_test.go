@@ -0,0 +1,115 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCostTrackerThrottlesExpensivePeer(t *testing.T) {
+	ct := NewCostTracker(CostTrackerConfig{
+		TargetCostPerByte: 1.0,
+		MinCapacity:       100,
+		MaxCapacity:       10000,
+		Alpha:             1, // no smoothing, makes the test deterministic
+	})
+	id := []byte("expensive-peer")
+	ct.Record(id, 4000, 1000) // 4 units/byte, way above target
+
+	cfg := ct.Renegotiate(id, Config{Capacity: 1000, Quantum: 100}, 0.5)
+	require.Less(t, cfg.Capacity, int64(1000), "an expensive peer must have its capacity reduced")
+	require.GreaterOrEqual(t, cfg.Capacity, int64(100), "capacity must not drop below MinCapacity")
+}
+
+func TestCostTrackerRaisesCheapUtilizedPeer(t *testing.T) {
+	ct := NewCostTracker(CostTrackerConfig{
+		TargetCostPerByte: 1.0,
+		MinCapacity:       100,
+		MaxCapacity:       10000,
+		Alpha:             1,
+	})
+	id := []byte("cheap-peer")
+	ct.Record(id, 100, 1000) // 0.1 units/byte, well under target
+
+	cfg := ct.Renegotiate(id, Config{Capacity: 1000, Quantum: 100}, 0.9)
+	require.Greater(t, cfg.Capacity, int64(1000), "a cheap, well-utilized peer should be raised")
+	require.LessOrEqual(t, cfg.Capacity, int64(10000), "capacity must not exceed MaxCapacity")
+}
+
+func TestCostTrackerLeavesUnknownPeerUnchanged(t *testing.T) {
+	ct := NewCostTracker(CostTrackerConfig{TargetCostPerByte: 1.0, Alpha: 1})
+	cfg := Config{Capacity: 1000, Quantum: 100}
+	require.Equal(t, cfg, ct.Renegotiate([]byte("never-seen"), cfg, 0.5))
+}
+
+func TestCostTrackerLeavesOnTargetPeerUnchanged(t *testing.T) {
+	ct := NewCostTracker(CostTrackerConfig{TargetCostPerByte: 1.0, Alpha: 1})
+	id := []byte("on-target-peer")
+	ct.Record(id, 1000, 1000)
+
+	cfg := Config{Capacity: 1000, Quantum: 100}
+	require.Equal(t, cfg, ct.Renegotiate(id, cfg, 0.9))
+}
+
+func TestAtomicConfigStoreLoad(t *testing.T) {
+	a := NewAtomicConfig(Config{Capacity: 100})
+	require.Equal(t, int64(100), a.Load().Capacity)
+
+	a.Store(Config{Capacity: 200})
+	require.Equal(t, int64(200), a.Load().Capacity)
+}
+
+func TestPeerConfigsGetCreatesOnFirstUse(t *testing.T) {
+	p := NewPeerConfigs()
+	id := []byte("peer-a")
+
+	cfg := p.Get(id, Config{Capacity: 42})
+	require.Equal(t, int64(42), cfg.Load().Capacity)
+	require.Same(t, cfg, p.Get(id, Config{Capacity: 99}), "Get must return the same AtomicConfig on repeat calls")
+
+	p.Remove(id)
+	require.NotSame(t, cfg, p.Get(id, Config{Capacity: 99}), "Get must re-create after Remove")
+}
+
+func TestCostTrackerRunAppliesRenegotiatedConfig(t *testing.T) {
+	ct := NewCostTracker(CostTrackerConfig{
+		TargetCostPerByte: 1.0,
+		// 1000 scales to 250 on the first tick and stays clamped there,
+		// so the stored config cannot move on after the first apply.
+		MinCapacity: 250,
+		MaxCapacity: 10000,
+		Alpha:       1,
+	})
+	id := []byte("expensive-peer")
+	ct.Record(id, 4000, 1000)
+
+	configs := NewPeerConfigs()
+	configs.Get(id, Config{Capacity: 1000, Quantum: 100})
+
+	applied := make(chan Config, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ct.Run(ctx, time.Millisecond, configs, func([]byte) float64 { return 0.5 }, func(id []byte, cfg Config) {
+			applied <- cfg
+		})
+		close(done)
+	}()
+
+	select {
+	case cfg := <-applied:
+		require.Less(t, cfg.Capacity, int64(1000))
+		require.Equal(t, cfg, configs.Get(id, Config{}).Load())
+	case <-time.After(time.Second):
+		require.FailNow(t, "Run never applied a renegotiated config")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Run did not stop after its context was cancelled")
+	}
+}
@@ -0,0 +1,164 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/stretchr/testify/require"
+)
+
+func testDistributorPeer(b byte) *p2p.Peer {
+	return p2p.NewPeer(discover.NodeID{b}, "test", nil)
+}
+
+func unlimited([]byte) int64 { return 1 << 30 }
+
+func TestDistributorServesHighestPriorityFirst(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	d := NewDistributor(egress, DistributorConfig{Quantum: 1 << 20, EgressBudget: 1 << 20})
+	peer := testDistributorPeer(1)
+
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{1}, Size: 10, Priority: PriorityHistorical})
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{2}, Size: 10, Priority: PriorityOwn})
+
+	deliveries := d.Tick(time.Now(), unlimited)
+	require.Len(t, deliveries, 1)
+	require.Equal(t, [32]byte{2}, deliveries[0].Envelopes[0].ID)
+}
+
+func TestDistributorServesOversizedEnvelopeThatFitsPeerBudget(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	d := NewDistributor(egress, DistributorConfig{Quantum: 5, EgressBudget: 1 << 20})
+	peer := testDistributorPeer(1)
+
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{1}, Size: 10, Priority: PriorityOwn})
+
+	deliveries := d.Tick(time.Now(), unlimited)
+	require.Len(t, deliveries, 1, "an envelope bigger than Quantum must still go out if the peer's own bucket has room for it")
+	require.Equal(t, [32]byte{1}, deliveries[0].Envelopes[0].ID)
+}
+
+func TestDistributorDefersEnvelopeUntilPeerBudgetAllows(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	d := NewDistributor(egress, DistributorConfig{Quantum: 1 << 20, EgressBudget: 1 << 20})
+	peer := testDistributorPeer(1)
+
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{1}, Size: 10, Priority: PriorityOwn})
+
+	var peerAvailable int64 = 5
+	available := func([]byte) int64 { return peerAvailable }
+
+	deliveries := d.Tick(time.Now(), available)
+	require.Empty(t, deliveries, "envelope bigger than the peer's current bucket must be deferred, not dropped")
+
+	peerAvailable = 10
+	deliveries = d.Tick(time.Now(), available)
+	require.Len(t, deliveries, 1, "deferred envelope must be delivered once the peer's bucket has room")
+}
+
+func TestDistributorExpiresEnvelope(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	d := NewDistributor(egress, DistributorConfig{Quantum: 1 << 20, EgressBudget: 1 << 20})
+	peer := testDistributorPeer(1)
+
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{1}, Size: 10, Priority: PriorityOwn, Expiry: time.Now().Add(-time.Second)})
+
+	deliveries := d.Tick(time.Now(), unlimited)
+	require.Empty(t, deliveries, "expired envelope must not be delivered")
+}
+
+func TestDistributorStarvationGuardPromotesPriority(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	// Budget only fits one envelope per tick, so as long as an own-priority
+	// envelope is queued alongside it, the historical one is never reached
+	// by ordinary priority order and can only be drained via promotion.
+	d := NewDistributor(egress, DistributorConfig{Quantum: 10, EgressBudget: 10, StarvationTicks: 2})
+	peer := testDistributorPeer(1)
+	key := string(egress.ID(peer))
+
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{1}, Size: 10, Priority: PriorityHistorical})
+
+	for i := 0; i < 2; i++ {
+		d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{2, byte(i)}, Size: 10, Priority: PriorityOwn})
+		deliveries := d.Tick(time.Now(), unlimited)
+		require.Len(t, deliveries, 1, "tick %d should drain only the competing own-priority envelope", i)
+		require.Equal(t, PriorityOwn, deliveries[0].Envelopes[0].Priority)
+	}
+
+	d.mu.Lock()
+	q := d.peers[key]
+	historicalLen := q.classes[PriorityHistorical].Len()
+	forwardedLen := q.classes[PriorityForwarded].Len()
+	d.mu.Unlock()
+	require.Equal(t, 0, historicalLen, "starved envelope should have been promoted out of historical")
+	require.Equal(t, 1, forwardedLen, "starved envelope should have been promoted into forwarded, not drained by ordinary priority order")
+}
+
+func TestDistributorRemovePeer(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	d := NewDistributor(egress, DistributorConfig{Quantum: 1 << 20, EgressBudget: 1 << 20})
+	peer := testDistributorPeer(1)
+
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{1}, Size: 10, Priority: PriorityOwn})
+	d.RemovePeer(peer)
+
+	deliveries := d.Tick(time.Now(), unlimited)
+	require.Empty(t, deliveries)
+}
+
+func TestDistributorTickRotatesStartPeerAcrossTicks(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	// Budget for exactly one envelope per tick, so whichever peer is
+	// served first each tick exhausts it.
+	d := NewDistributor(egress, DistributorConfig{Quantum: 10, EgressBudget: 10})
+	peer1, peer2, peer3 := testDistributorPeer(1), testDistributorPeer(2), testDistributorPeer(3)
+
+	for i := 0; i < 3; i++ {
+		d.Enqueue(peer1, EnvelopeMeta{ID: [32]byte{1, byte(i)}, Size: 10, Priority: PriorityOwn})
+		d.Enqueue(peer2, EnvelopeMeta{ID: [32]byte{2, byte(i)}, Size: 10, Priority: PriorityOwn})
+		d.Enqueue(peer3, EnvelopeMeta{ID: [32]byte{3, byte(i)}, Size: 10, Priority: PriorityOwn})
+	}
+
+	served := map[string]int{}
+	for i := 0; i < 3; i++ {
+		deliveries := d.Tick(time.Now(), unlimited)
+		require.Len(t, deliveries, 1, "tick %d should serve exactly one peer under a one-envelope budget", i)
+		served[string(deliveries[0].PeerID)]++
+	}
+
+	require.Len(t, served, 3, "every peer should have been served first exactly once across 3 ticks, not just the first-registered one")
+	for peerID, count := range served {
+		require.Equal(t, 1, count, "peer %x should have been served exactly once", peerID)
+	}
+}
+
+func TestDistributorRunStopsOnCancel(t *testing.T) {
+	egress := NewPeerRateLimiter(IDMode, nil)
+	d := NewDistributor(egress, DistributorConfig{Quantum: 1 << 20, EgressBudget: 1 << 20})
+	peer := testDistributorPeer(1)
+	d.Enqueue(peer, EnvelopeMeta{ID: [32]byte{1}, Size: 10, Priority: PriorityOwn})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	delivered := make(chan Delivery, 1)
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx, time.Millisecond, unlimited, func(delivery Delivery) { delivered <- delivery })
+		close(done)
+	}()
+
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Run never delivered the queued envelope")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		require.FailNow(t, "Run did not stop after its context was cancelled")
+	}
+}
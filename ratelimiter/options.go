@@ -0,0 +1,49 @@
+package ratelimiter
+
+// options collects the optional behaviour NewPeerRateLimiter/ForWhisper
+// accept, so new knobs (subnet prefix lengths, stats subscribers, ...)
+// can be added without growing their positional argument lists.
+type options struct {
+	ipv4Prefix  int
+	ipv6Prefix  int
+	subs        []RateStatsSubscriber
+	costTracker *CostTracker
+}
+
+// Option configures a PeerRateLimiter/Whisper at construction time.
+type Option func(*options)
+
+func newOptions(opts ...Option) options {
+	// /24 and /64 mirror the prefix lengths most eth/whisper peer
+	// discovery and abuse-mitigation tooling already assumes for IPv4
+	// and IPv6 respectively.
+	o := options{ipv4Prefix: 24, ipv6Prefix: 64}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithIPv4Prefix sets the CIDR prefix length SubnetMode masks IPv4
+// addresses to before keying a bucket. Default is /24.
+func WithIPv4Prefix(n int) Option {
+	return func(o *options) { o.ipv4Prefix = n }
+}
+
+// WithIPv6Prefix sets the CIDR prefix length SubnetMode masks IPv6
+// addresses to before keying a bucket. Default is /64.
+func WithIPv6Prefix(n int) Option {
+	return func(o *options) { o.ipv6Prefix = n }
+}
+
+// WithRateStats registers sub to be notified every time ForWhisper's
+// Stats subsystem refreshes its per-peer bandwidth windows.
+func WithRateStats(sub RateStatsSubscriber) Option {
+	return func(o *options) { o.subs = append(o.subs, sub) }
+}
+
+// WithCostTracker attaches tracker to the ingress PeerRateLimiter
+// ForWhisper returns, so RecordCost calls feed it.
+func WithCostTracker(tracker *CostTracker) Option {
+	return func(o *options) { o.costTracker = tracker }
+}
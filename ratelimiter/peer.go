@@ -1,11 +1,11 @@
 package ratelimiter
 
 import (
+	"context"
 	"net"
-	"strings"
 	"time"
 
-	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
 )
 
 const (
@@ -13,74 +13,234 @@ const (
 	IDMode = 1 + iota
 	// IPMode enables rate limiting based on peer external ip address.
 	IPMode
+	// SubnetMode enables rate limiting based on the peer's IP masked to
+	// a CIDR prefix (see WithIPv4Prefix/WithIPv6Prefix), so an attacker
+	// controlling many addresses within one subnet cannot bypass
+	// per-peer limits by cycling IPs the way IPMode can be bypassed.
+	SubnetMode
 )
 
-func byIP(peer *p2p.Peer) []byte {
-	addr := peer.RemoteAddr().Network()
-	ip := net.ParseIP(strings.Split(addr, ":")[0])
-	return []byte(ip)
+// Peer is the subset of p2p.Peer a rate limiter needs to key its
+// buckets. It exists so that transports other than devp2p, which don't
+// have a *p2p.Peer of their own (libp2p, for instance), can build a
+// lightweight adapter and reuse PeerRateLimiter as-is.
+type Peer interface {
+	ID() discover.NodeID
+	RemoteAddr() net.Addr
 }
 
-func byID(peer *p2p.Peer) []byte {
+func peerIP(peer Peer) net.IP {
+	addr := peer.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		// addr had no port, e.g. it was already a bare IP.
+		host = addr
+	}
+	return net.ParseIP(host)
+}
+
+func byIP(peer Peer) []byte {
+	return []byte(peerIP(peer))
+}
+
+func byID(peer Peer) []byte {
 	return peer.ID().Bytes()
 }
 
+// bySubnet returns a modeFunc that keys a peer by its IP masked to
+// ipv4Prefix (for IPv4 peers) or ipv6Prefix (for IPv6 peers) bits,
+// aggregating every peer in the same subnet into one bucket.
+func bySubnet(ipv4Prefix, ipv6Prefix int) modeFunc {
+	return func(peer Peer) []byte {
+		ip := peerIP(peer)
+		if ip == nil {
+			return nil
+		}
+		prefix := ipv6Prefix
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			prefix = ipv4Prefix
+		}
+		mask := net.CIDRMask(prefix, len(ip)*8)
+		return []byte(ip.Mask(mask))
+	}
+}
+
 // modeFunc specifies function to obtain ID value from peer.
-type modeFunc func(peer *p2p.Peer) []byte
+type modeFunc func(peer Peer) []byte
 
 // selectFunc returns idModeFunc by default.
-func selectFunc(mode int) modeFunc {
-	if mode == IPMode {
+func selectFunc(mode int, opts ...Option) modeFunc {
+	switch mode {
+	case IPMode:
 		return byIP
+	case SubnetMode:
+		o := newOptions(opts...)
+		return bySubnet(o.ipv4Prefix, o.ipv6Prefix)
+	default:
+		return byID
 	}
-	return byID
 }
 
 // NewPeerRateLimiter returns an instance of PeerRateLimiter.
-func NewPeerRateLimiter(mode int, ratelimiter Interface) PeerRateLimiter {
+func NewPeerRateLimiter(mode int, ratelimiter Interface, opts ...Option) PeerRateLimiter {
 	return PeerRateLimiter{
-		getID:       selectFunc(mode),
+		getID:       selectFunc(mode, opts...),
 		ratelimiter: ratelimiter,
 	}
 }
 
-// PeerRateLimiter implements rate limiter that accepts p2p.Peer as identifier.
+// PeerRateLimiter implements rate limiter that accepts a Peer as identifier.
 type PeerRateLimiter struct {
 	getID       modeFunc
 	ratelimiter Interface
+	stats       *Stats
+	direction   statsDirection
+	cost        *CostTracker
 }
 
 // Create instantiates rate limiter with for a peer.
-func (r PeerRateLimiter) Create(peer *p2p.Peer, cfg Config) error {
+func (r PeerRateLimiter) Create(peer Peer, cfg Config) error {
+	return r.ratelimiter.Create(r.getID(peer), cfg)
+}
+
+// Reconfigure replaces the Config backing peer's bucket, e.g. after a
+// CostTracker.Renegotiate decision or an incoming rate-limit update from
+// the peer itself.
+func (r PeerRateLimiter) Reconfigure(peer Peer, cfg Config) error {
 	return r.ratelimiter.Create(r.getID(peer), cfg)
 }
 
 // Remove drops peer from in-memory rate limiter. If duration is non-zero peer will be blacklisted.
-func (r PeerRateLimiter) Remove(peer *p2p.Peer, duration time.Duration) error {
+func (r PeerRateLimiter) Remove(peer Peer, duration time.Duration) error {
 	return r.ratelimiter.Remove(r.getID(peer), duration)
 }
 
 // TakeAvailable subtracts given amount up to the available limit.
-func (r PeerRateLimiter) TakeAvailable(peer *p2p.Peer, count int64) int64 {
-	return r.ratelimiter.TakeAvailable(r.getID(peer), count)
+func (r PeerRateLimiter) TakeAvailable(peer Peer, count int64) int64 {
+	taken := r.ratelimiter.TakeAvailable(r.getID(peer), count)
+	if r.stats != nil {
+		r.stats.record(r.getID(peer), r.direction, taken)
+	}
+	return taken
+}
+
+// RecordEnvelope tallies an envelope seen for peer under topic in the
+// Stats subsystem, if one is attached. Callers should invoke this
+// alongside TakeAvailable once the envelope's topic is known.
+func (r PeerRateLimiter) RecordEnvelope(peer Peer, topic [4]byte) {
+	if r.stats != nil {
+		r.stats.RecordEnvelope(r.getID(peer), topic)
+	}
+}
+
+// RecordCost feeds the cost of processing one packet from peer into the
+// attached CostTracker, if any: units is the work done to validate it
+// (PoW check, bloom-filter match, decryption), size is its wire size.
+// Callers invoke this once that cost is known, typically alongside
+// TakeAvailable. It is a no-op if no CostTracker is attached.
+func (r PeerRateLimiter) RecordCost(peer Peer, units float64, size int64) {
+	if r.cost != nil {
+		r.cost.Record(r.getID(peer), units, size)
+	}
 }
 
 // Available peeks into the current available limit.
-func (r PeerRateLimiter) Available(peer *p2p.Peer) int64 {
+func (r PeerRateLimiter) Available(peer Peer) int64 {
 	return r.ratelimiter.Available(r.getID(peer))
 }
 
+// ID returns the key this PeerRateLimiter would use to track peer, as
+// determined by its mode (IDMode/IPMode/...). It is exposed so other
+// subsystems, such as Distributor, can key their own per-peer state the
+// same way without duplicating the mode logic.
+func (r PeerRateLimiter) ID(peer Peer) []byte {
+	return r.getID(peer)
+}
+
 // Whisper is a convenience wrapper for whisper.
 type Whisper struct {
 	Ingress, Egress PeerRateLimiter
 	Config          Config
+	// Stats reports per-peer bandwidth, sampled every second. It is nil
+	// only if Whisper was constructed outside of ForWhisper.
+	Stats *Stats
+	// CostTracker measures the true per-peer packet cost and
+	// re-derives Capacity/Quantum from it; it is non-nil only if
+	// ForWhisper was given WithCostTracker. PeerConfigs holds the
+	// canonical, live Config each peer was last renegotiated to; callers
+	// driving CostTracker.Run pass it both.
+	CostTracker *CostTracker
+	PeerConfigs *PeerConfigs
+
+	cancel context.CancelFunc
 }
 
-// ForWhisper returns a convenient wrapper to be used in whisper.
-func ForWhisper(mode int, db DBInterface, ingress Config) Whisper {
+// statsSampleInterval is how often Stats refreshes its EWMA windows and
+// notifies subscribers registered through ForWhisper.
+const statsSampleInterval = time.Second
+
+// ForWhisper returns a convenient wrapper to be used in whisper. Its
+// background work (currently, Stats' sampling loop) runs until ctx is
+// done or Close is called, whichever happens first. opts configures
+// optional behaviour: WithIPv4Prefix/WithIPv6Prefix set the subnet size
+// used by SubnetMode, WithRateStats registers a subscriber to be
+// notified every time per-peer bandwidth stats are refreshed (see
+// Stats), and WithCostTracker attaches a CostTracker to the ingress
+// limiter so RecordCost calls feed it; callers that do so should also
+// drive CostTracker.Run off the returned CostTracker/PeerConfigs to
+// apply its renegotiation decisions.
+func ForWhisper(ctx context.Context, mode int, db DBInterface, ingress Config, opts ...Option) Whisper {
+	o := newOptions(opts...)
+	ctx, cancel := context.WithCancel(ctx)
+	stats := NewStats(statsSampleInterval)
+	for _, sub := range o.subs {
+		stats.Subscribe(sub)
+	}
+	stats.Start(ctx)
+	getID := selectFunc(mode, opts...)
+
+	var peerConfigs *PeerConfigs
+	if o.costTracker != nil {
+		peerConfigs = NewPeerConfigs()
+	}
+
 	return Whisper{
-		Ingress: NewPeerRateLimiter(mode, NewPersisted(WithPrefix(db, []byte("i")))),
-		Egress:  NewPeerRateLimiter(mode, NewPersisted(WithPrefix(db, []byte("e")))),
-		Config:  ingress,
+		Ingress: PeerRateLimiter{
+			getID:       getID,
+			ratelimiter: NewPersisted(WithPrefix(db, []byte("i"))),
+			stats:       stats,
+			direction:   ingressDirection,
+			cost:        o.costTracker,
+		},
+		Egress: PeerRateLimiter{
+			getID:       getID,
+			ratelimiter: NewPersisted(WithPrefix(db, []byte("e"))),
+			stats:       stats,
+			direction:   egressDirection,
+		},
+		Config:      ingress,
+		Stats:       stats,
+		CostTracker: o.costTracker,
+		PeerConfigs: peerConfigs,
+		cancel:      cancel,
 	}
 }
+
+// Close stops Stats' sampling loop, the only background work ForWhisper
+// itself starts. It is idempotent. Distributor.Run and CostTracker.Run
+// are not started by ForWhisper and are not covered, nor is
+// whisperv6.Whisper.HandlePeer's per-peer read loop, which lives outside
+// this tree slice.
+func (w Whisper) Close() {
+	if w.cancel != nil {
+		w.cancel()
+	}
+}
+
+// Rates returns the current bandwidth estimate for peer, as measured by
+// Stats. It reads whichever side (ingress or egress) has observed the
+// peer; both sides share the same underlying Stats instance.
+func (w Whisper) Rates(peer Peer) PeerStats {
+	return w.Stats.Rates(w.Ingress.getID(peer))
+}
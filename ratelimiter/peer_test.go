@@ -25,3 +25,19 @@ func TestIDMode(t *testing.T) {
 	peerrl.Available(peer)
 	require.NoError(t, peerrl.Remove(peer, 0))
 }
+
+func TestPeerRateLimiterReconfigure(t *testing.T) {
+	peer := p2p.NewPeer(discover.NodeID{1}, "test", nil)
+	next := Config{Capacity: 500}
+	ctrl := gomock.NewController(t)
+	rl := NewMockInterface(ctrl)
+	rl.EXPECT().Create(peer.ID().Bytes(), next)
+	peerrl := NewPeerRateLimiter(IDMode, rl)
+	require.NoError(t, peerrl.Reconfigure(peer, next))
+}
+
+func TestPeerRateLimiterRecordCostNoopWithoutTracker(t *testing.T) {
+	peer := p2p.NewPeer(discover.NodeID{1}, "test", nil)
+	peerrl := NewPeerRateLimiter(IDMode, nil)
+	require.NotPanics(t, func() { peerrl.RecordCost(peer, 10, 10) })
+}
@@ -0,0 +1,207 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// statsDirection distinguishes which side of a PeerRateLimiter a sample
+// belongs to, so that Stats can attribute it to the right EWMA set.
+type statsDirection int
+
+const (
+	ingressDirection statsDirection = iota
+	egressDirection
+)
+
+// RateStatsSubscriber is notified every time Stats refreshes its EWMA
+// windows for a peer.
+type RateStatsSubscriber interface {
+	NotifyRates(id []byte, stats PeerStats)
+}
+
+// PeerStats is a snapshot of the measured throughput for a single peer,
+// as 1s/10s/60s EWMAs of bytes/second.
+type PeerStats struct {
+	IngressRate1s, IngressRate10s, IngressRate60s float64
+	EgressRate1s, EgressRate10s, EgressRate60s    float64
+	// EnvelopesByTopic counts envelopes seen for this peer, keyed by the
+	// raw 4-byte topic.
+	EnvelopesByTopic map[[4]byte]uint64
+}
+
+// ewma is a simple exponentially-weighted moving average updated once per
+// tick with the instantaneous rate observed during that tick.
+type ewma struct {
+	rate  float64
+	alpha float64
+	init  bool
+}
+
+func newEWMA(window, tick time.Duration) *ewma {
+	return &ewma{alpha: 1 - math.Exp(-float64(tick)/float64(window))}
+}
+
+func (e *ewma) update(sample float64) {
+	if !e.init {
+		e.rate = sample
+		e.init = true
+		return
+	}
+	e.rate += e.alpha * (sample - e.rate)
+}
+
+type ewmaSet struct {
+	s1, s10, s60 *ewma
+}
+
+func newEWMASet(tick time.Duration) ewmaSet {
+	return ewmaSet{
+		s1:  newEWMA(time.Second, tick),
+		s10: newEWMA(10*time.Second, tick),
+		s60: newEWMA(60*time.Second, tick),
+	}
+}
+
+func (e *ewmaSet) update(sample float64) {
+	e.s1.update(sample)
+	e.s10.update(sample)
+	e.s60.update(sample)
+}
+
+// peerCounters accumulates raw byte counts between samples and holds the
+// derived EWMA sets for a single peer.
+type peerCounters struct {
+	ingress, egress       ewmaSet
+	pendingIn, pendingOut int64
+	topics                map[[4]byte]uint64
+}
+
+// Stats samples per-peer ingress/egress byte counters into EWMA windows
+// plus a per-topic envelope tally. It is safe for concurrent use.
+type Stats struct {
+	mu    sync.Mutex
+	tick  time.Duration
+	peers map[string]*peerCounters
+	subs  []RateStatsSubscriber
+}
+
+// NewStats returns a Stats sampler that refreshes its EWMA windows every
+// tick.
+func NewStats(tick time.Duration) *Stats {
+	return &Stats{
+		tick:  tick,
+		peers: make(map[string]*peerCounters),
+	}
+}
+
+// Subscribe registers sub to be notified on every sampling tick.
+func (s *Stats) Subscribe(sub RateStatsSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs = append(s.subs, sub)
+}
+
+// Start begins the sampling loop in a new goroutine, which runs until
+// ctx is done.
+func (s *Stats) Start(ctx context.Context) {
+	go s.loop(ctx)
+}
+
+func (s *Stats) loop(ctx context.Context) {
+	ticker := time.NewTicker(s.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sample()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// record accumulates n bytes taken from the bucket for id in the given
+// direction. It is called from PeerRateLimiter.TakeAvailable.
+func (s *Stats) record(id []byte, dir statsDirection, n int64) {
+	if n <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.peerLocked(string(id))
+	if dir == ingressDirection {
+		c.pendingIn += n
+	} else {
+		c.pendingOut += n
+	}
+}
+
+// RecordEnvelope tallies an envelope seen for id under topic.
+func (s *Stats) RecordEnvelope(id []byte, topic [4]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.peerLocked(string(id))
+	c.topics[topic]++
+}
+
+func (s *Stats) peerLocked(key string) *peerCounters {
+	c, ok := s.peers[key]
+	if !ok {
+		c = &peerCounters{
+			ingress: newEWMASet(s.tick),
+			egress:  newEWMASet(s.tick),
+			topics:  make(map[[4]byte]uint64),
+		}
+		s.peers[key] = c
+	}
+	return c
+}
+
+func (s *Stats) sample() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	perTick := s.tick.Seconds()
+	for key, c := range s.peers {
+		c.ingress.update(float64(c.pendingIn) / perTick)
+		c.egress.update(float64(c.pendingOut) / perTick)
+		c.pendingIn, c.pendingOut = 0, 0
+
+		if len(s.subs) == 0 {
+			continue
+		}
+		stats := snapshot(c)
+		for _, sub := range s.subs {
+			sub.NotifyRates([]byte(key), stats)
+		}
+	}
+}
+
+func snapshot(c *peerCounters) PeerStats {
+	topics := make(map[[4]byte]uint64, len(c.topics))
+	for k, v := range c.topics {
+		topics[k] = v
+	}
+	return PeerStats{
+		IngressRate1s:    c.ingress.s1.rate,
+		IngressRate10s:   c.ingress.s10.rate,
+		IngressRate60s:   c.ingress.s60.rate,
+		EgressRate1s:     c.egress.s1.rate,
+		EgressRate10s:    c.egress.s10.rate,
+		EgressRate60s:    c.egress.s60.rate,
+		EnvelopesByTopic: topics,
+	}
+}
+
+// Rates peeks at the current bandwidth estimate for id.
+func (s *Stats) Rates(id []byte) PeerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.peers[string(id)]
+	if !ok {
+		return PeerStats{EnvelopesByTopic: map[[4]byte]uint64{}}
+	}
+	return snapshot(c)
+}
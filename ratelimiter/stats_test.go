@@ -0,0 +1,62 @@
+package ratelimiter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type recordingSubscriber struct {
+	calls chan PeerStats
+}
+
+func (s *recordingSubscriber) NotifyRates(id []byte, stats PeerStats) {
+	s.calls <- stats
+}
+
+func TestStatsRecordsIngressAndEgress(t *testing.T) {
+	s := NewStats(10 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s.Start(ctx)
+
+	id := []byte("peer-1")
+	s.record(id, ingressDirection, 1024)
+	s.record(id, egressDirection, 512)
+	s.RecordEnvelope(id, [4]byte{1, 2, 3, 4})
+
+	require.Eventually(t, func() bool {
+		rates := s.Rates(id)
+		return rates.IngressRate1s > 0 && rates.EgressRate1s > 0
+	}, time.Second, 5*time.Millisecond)
+
+	rates := s.Rates(id)
+	require.Equal(t, uint64(1), rates.EnvelopesByTopic[[4]byte{1, 2, 3, 4}])
+}
+
+func TestStatsNotifiesSubscribers(t *testing.T) {
+	s := NewStats(10 * time.Millisecond)
+	sub := &recordingSubscriber{calls: make(chan PeerStats, 1)}
+	s.Subscribe(sub)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	s.Start(ctx)
+
+	s.record([]byte("peer-1"), ingressDirection, 100)
+
+	select {
+	case stats := <-sub.calls:
+		require.True(t, stats.IngressRate1s > 0)
+	case <-time.After(time.Second):
+		require.FailNow(t, "subscriber was not notified")
+	}
+}
+
+func TestStatsRatesUnknownPeer(t *testing.T) {
+	s := NewStats(time.Second)
+	rates := s.Rates([]byte("unknown"))
+	require.Empty(t, rates.EnvelopesByTopic)
+	require.Zero(t, rates.IngressRate1s)
+}
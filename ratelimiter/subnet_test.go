@@ -0,0 +1,48 @@
+package ratelimiter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+type fakePeer struct {
+	addr fakeAddr
+}
+
+func (p fakePeer) ID() discover.NodeID  { return discover.NodeID{} }
+func (p fakePeer) RemoteAddr() net.Addr { return p.addr }
+
+func TestBySubnetAggregatesIPv4Peers(t *testing.T) {
+	f := bySubnet(24, 64)
+	a := fakePeer{addr: "10.0.0.1:30303"}
+	b := fakePeer{addr: "10.0.0.2:30303"}
+	c := fakePeer{addr: "10.0.1.1:30303"}
+
+	require.Equal(t, f(a), f(b), "peers in the same /24 must collide into one bucket")
+	require.NotEqual(t, f(a), f(c), "peers in different /24s must not collide")
+}
+
+func TestBySubnetAggregatesIPv6Peers(t *testing.T) {
+	f := bySubnet(24, 64)
+	a := fakePeer{addr: "[2001:db8::1]:30303"}
+	b := fakePeer{addr: "[2001:db8::2]:30303"}
+	c := fakePeer{addr: "[2001:db9::1]:30303"}
+
+	require.Equal(t, f(a), f(b), "peers in the same /64 must collide into one bucket")
+	require.NotEqual(t, f(a), f(c), "peers in different /64s must not collide")
+}
+
+func TestSelectFuncSubnetMode(t *testing.T) {
+	f := selectFunc(SubnetMode, WithIPv4Prefix(16))
+	a := fakePeer{addr: "172.16.1.1:1"}
+	b := fakePeer{addr: "172.16.2.1:1"}
+	require.Equal(t, f(a), f(b))
+}
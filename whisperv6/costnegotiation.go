@@ -0,0 +1,57 @@
+package whisperv6
+
+import (
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/status-im/whisper/ratelimiter"
+)
+
+// peerRateLimitUpdateCode extends the rate-limit handshake started by
+// peerRateLimitCode: either side may send it at any point on the
+// connection to ask the other to adopt a new ingress Capacity/Quantum,
+// as derived by a ratelimiter.CostTracker from the true cost of
+// processing that peer's packets (PoW validation, bloom-filter
+// matching, decryption).
+const peerRateLimitUpdateCode = peerRateLimitCode + 1
+
+// rateLimitUpdate is the payload of peerRateLimitUpdateCode.
+type rateLimitUpdate struct {
+	Capacity int64
+	Quantum  int64
+}
+
+// sendRateLimitUpdate asks the remote end of rw to adopt cfg as the
+// allowance for its egress bucket on this connection.
+func sendRateLimitUpdate(rw p2p.MsgWriter, cfg ratelimiter.Config) error {
+	return p2p.Send(rw, peerRateLimitUpdateCode, rateLimitUpdate{Capacity: cfg.Capacity, Quantum: cfg.Quantum})
+}
+
+// handleRateLimitUpdate decodes an incoming peerRateLimitUpdateCode
+// packet and applies it to limiter, the local egress PeerRateLimiter for
+// peer. Whisper.HandlePeer's dispatch switch in whisper.go is meant to
+// call this on packet.Code == peerRateLimitUpdateCode; that switch lives
+// outside this tree slice and doesn't call it yet.
+func handleRateLimitUpdate(packet p2p.Msg, limiter ratelimiter.PeerRateLimiter, peer ratelimiter.Peer) error {
+	var update rateLimitUpdate
+	if err := packet.Decode(&update); err != nil {
+		return err
+	}
+	return limiter.Reconfigure(peer, ratelimiter.Config{Capacity: update.Capacity, Quantum: update.Quantum})
+}
+
+// renegotiateIngress returns the apply callback ratelimiter.CostTracker.Run
+// expects: it pushes cfg onto limiter's bucket for peer and mirrors it to
+// the remote side over rw via peerRateLimitUpdateCode. Actually driving
+// CostTracker.Run per peer, and feeding it via RecordCost, happens from
+// Whisper.HandlePeer in whisper.go - outside this tree slice, not done here.
+func renegotiateIngress(limiter ratelimiter.PeerRateLimiter, peer ratelimiter.Peer, rw p2p.MsgWriter) func(id []byte, cfg ratelimiter.Config) {
+	return func(id []byte, cfg ratelimiter.Config) {
+		if err := limiter.Reconfigure(peer, cfg); err != nil {
+			log.Error("whisper: failed to apply renegotiated rate limit", "err", err)
+			return
+		}
+		if err := sendRateLimitUpdate(rw, cfg); err != nil {
+			log.Error("whisper: failed to send rate limit update", "err", err)
+		}
+	}
+}